@@ -0,0 +1,175 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect abstracts the SQL syntax differences between database engines so
+// that Storage can be reused against SQLite, Postgres and MySQL without
+// branching on the driver throughout the rest of the package.
+type Dialect interface {
+	// Schema returns the DDL used to create the mt_nodes and mt_roots
+	// tables, using this dialect's column types.
+	Schema() string
+	// UpsertNode returns the statement used by Put to write a node version.
+	// Its placeholders, in order, are: mt_id, key, type, child_l, child_r,
+	// entry, created_at. It must upsert on (mt_id, key, created_at) rather
+	// than plain-insert: Put can be called more than once for the same key
+	// before the next SetRoot bumps the version, and those calls share the
+	// same created_at.
+	UpsertNode() string
+	// UpsertRoot returns the statement used by SetRoot to append a new root
+	// version. Its placeholders, in order, are: mt_id, prefix, key,
+	// created_at. prefix namespaces mt_roots the same way Get/Put namespace
+	// mt_nodes keys, so WithPrefix sub-trees sharing an mt_id each keep
+	// their own root history.
+	UpsertRoot() string
+	// PlaceholderN returns the bind-variable placeholder for the i-th
+	// (1-indexed) argument of a statement.
+	PlaceholderN(i int) string
+}
+
+// bind rewrites the portable "?" placeholders used throughout this package
+// into the bind-variable syntax the dialect actually requires, e.g.
+// Postgres' $1, $2, ...
+func bind(d Dialect, query string) string {
+	if !strings.ContainsRune(query, '?') {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.PlaceholderN(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SQLiteDialect is the Dialect for SQLite, the backend this package was
+// originally written against.
+type SQLiteDialect struct{}
+
+func (SQLiteDialect) Schema() string { return sqliteSchema }
+
+func (SQLiteDialect) UpsertNode() string {
+	return `INSERT INTO mt_nodes (mt_id, key, type, child_l, child_r, entry, created_at) ` +
+		`VALUES (?, ?, ?, ?, ?, ?, ?) ` +
+		`ON CONFLICT (mt_id, key, created_at) DO UPDATE SET ` +
+		`type = excluded.type, child_l = excluded.child_l, child_r = excluded.child_r, entry = excluded.entry`
+}
+
+func (SQLiteDialect) UpsertRoot() string {
+	return `INSERT INTO mt_roots (mt_id, prefix, key, created_at) VALUES (?, ?, ?, ?)`
+}
+
+func (SQLiteDialect) PlaceholderN(int) string { return "?" }
+
+// MySQLDialect is the Dialect for MySQL/MariaDB.
+type MySQLDialect struct{}
+
+func (MySQLDialect) Schema() string { return mysqlSchema }
+
+func (MySQLDialect) UpsertNode() string {
+	return `INSERT INTO mt_nodes (mt_id, key, type, child_l, child_r, entry, created_at) ` +
+		`VALUES (?, ?, ?, ?, ?, ?, ?) ` +
+		`ON DUPLICATE KEY UPDATE type = VALUES(type), child_l = VALUES(child_l), ` +
+		`child_r = VALUES(child_r), entry = VALUES(entry)`
+}
+
+func (MySQLDialect) UpsertRoot() string {
+	return `INSERT INTO mt_roots (mt_id, prefix, key, created_at) VALUES (?, ?, ?, ?)`
+}
+
+func (MySQLDialect) PlaceholderN(int) string { return "?" }
+
+// PostgresDialect is the Dialect for Postgres.
+type PostgresDialect struct{}
+
+func (PostgresDialect) Schema() string { return postgresSchema }
+
+func (PostgresDialect) UpsertNode() string {
+	return `INSERT INTO mt_nodes (mt_id, key, type, child_l, child_r, entry, created_at) ` +
+		`VALUES ($1, $2, $3, $4, $5, $6, $7) ` +
+		`ON CONFLICT (mt_id, key, created_at) DO UPDATE SET ` +
+		`type = excluded.type, child_l = excluded.child_l, child_r = excluded.child_r, entry = excluded.entry`
+}
+
+func (PostgresDialect) UpsertRoot() string {
+	return `INSERT INTO mt_roots (mt_id, prefix, key, created_at) VALUES ($1, $2, $3, $4)`
+}
+
+func (PostgresDialect) PlaceholderN(i int) string { return "$" + strconv.Itoa(i) }
+
+const sqliteSchema = `
+  CREATE TABLE IF NOT EXISTS mt_nodes (
+    mt_id INTEGER,
+    key BLOB,
+    type INTEGER NOT NULL,
+    child_l BLOB,
+    child_r BLOB,
+    entry BLOB,
+    created_at INTEGER,
+    deleted_at INTEGER,
+    PRIMARY KEY(mt_id, key, created_at)
+  );
+
+  CREATE TABLE IF NOT EXISTS mt_roots (
+    mt_id INTEGER,
+    prefix BLOB NOT NULL DEFAULT '',
+    key BLOB,
+    created_at INTEGER,
+    deleted_at INTEGER,
+    PRIMARY KEY(mt_id, prefix, created_at)
+  );
+`
+
+const mysqlSchema = `
+  CREATE TABLE IF NOT EXISTS mt_nodes (
+    mt_id BIGINT UNSIGNED NOT NULL,
+    ` + "`key`" + ` VARBINARY(255) NOT NULL,
+    type TINYINT UNSIGNED NOT NULL,
+    child_l BINARY(32),
+    child_r BINARY(32),
+    entry VARBINARY(64),
+    created_at BIGINT UNSIGNED,
+    deleted_at BIGINT UNSIGNED,
+    PRIMARY KEY(mt_id, ` + "`key`" + `, created_at)
+  );
+
+  CREATE TABLE IF NOT EXISTS mt_roots (
+    mt_id BIGINT UNSIGNED NOT NULL,
+    prefix VARBINARY(255) NOT NULL DEFAULT '',
+    ` + "`key`" + ` BINARY(32),
+    created_at BIGINT UNSIGNED NOT NULL,
+    deleted_at BIGINT UNSIGNED,
+    PRIMARY KEY(mt_id, prefix, created_at)
+  );
+`
+
+const postgresSchema = `
+  CREATE TABLE IF NOT EXISTS mt_nodes (
+    mt_id BIGINT NOT NULL,
+    key BYTEA NOT NULL,
+    type SMALLINT NOT NULL,
+    child_l BYTEA,
+    child_r BYTEA,
+    entry BYTEA,
+    created_at BIGINT,
+    deleted_at BIGINT,
+    PRIMARY KEY(mt_id, key, created_at)
+  );
+
+  CREATE TABLE IF NOT EXISTS mt_roots (
+    mt_id BIGINT NOT NULL,
+    prefix BYTEA NOT NULL DEFAULT '',
+    key BYTEA,
+    created_at BIGINT NOT NULL,
+    deleted_at BIGINT,
+    PRIMARY KEY(mt_id, prefix, created_at)
+  );
+`
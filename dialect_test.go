@@ -0,0 +1,47 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindLeavesQueryWithoutPlaceholdersUnchanged(t *testing.T) {
+	query := "SELECT 1"
+	require.Equal(t, query, bind(PostgresDialect{}, query))
+}
+
+func TestBindIsNoopForQuestionMarkDialects(t *testing.T) {
+	query := "SELECT * FROM t WHERE a = ? AND b = ?"
+	require.Equal(t, query, bind(SQLiteDialect{}, query))
+	require.Equal(t, query, bind(MySQLDialect{}, query))
+}
+
+func TestBindRewritesPlaceholdersPastNineArgs(t *testing.T) {
+	// 11 placeholders exercises the multi-digit $10, $11 case, not just $1-$9.
+	query := strings.Repeat("?, ", 10) + "?"
+
+	want := make([]string, 11)
+	for i := range want {
+		want[i] = "$" + strconv.Itoa(i+1)
+	}
+	require.Equal(t, strings.Join(want, ", "), bind(PostgresDialect{}, query))
+}
+
+func TestPostgresDialectPlaceholderN(t *testing.T) {
+	d := PostgresDialect{}
+	require.Equal(t, "$1", d.PlaceholderN(1))
+	require.Equal(t, "$9", d.PlaceholderN(9))
+	require.Equal(t, "$12", d.PlaceholderN(12))
+}
+
+func TestDialectsProduceUsableSQL(t *testing.T) {
+	for _, d := range []Dialect{SQLiteDialect{}, MySQLDialect{}, PostgresDialect{}} {
+		require.Contains(t, d.Schema(), "mt_nodes")
+		require.Contains(t, d.Schema(), "mt_roots")
+		require.Contains(t, d.UpsertNode(), "INSERT INTO mt_nodes")
+		require.Contains(t, d.UpsertRoot(), "INSERT INTO mt_roots")
+	}
+}
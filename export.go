@@ -0,0 +1,271 @@
+package sql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/iden3/go-merkletree-sql/v2"
+)
+
+// exportMagic identifies the binary snapshot format produced by Export.
+var exportMagic = [4]byte{'s', 'm', 't', '1'}
+
+// exportVersion is the format version written by this package. It lets a
+// future incompatible format change be rejected by Import instead of
+// silently misparsed.
+const exportVersion = 1
+
+// ErrImportNotEmpty is returned by Import when the target mt_id already has
+// data and Force was not requested.
+var ErrImportNotEmpty = errors.New("sql: mt_id is not empty, import would overwrite it")
+
+// ErrImportCorrupt is returned by Import when the snapshot fails to
+// validate: either it isn't in the expected format, or the claimed root
+// does not resolve against the imported nodes.
+var ErrImportCorrupt = errors.New("sql: snapshot is corrupt or does not validate")
+
+// Export streams every live node for this mt_id, plus the current root, to
+// w in a self-describing binary format: a header (magic, format version,
+// mtId, root hash, node count) followed by one record per node, whose key
+// and entry are length-prefixed. It is the counterpart to Import, and is meant for migrating a tree
+// between backends or taking an offline backup.
+func (s *Storage) Export(ctx context.Context, w io.Writer) error {
+	root, err := s.GetRoot(ctx)
+	if err != nil {
+		return err
+	}
+
+	kvs, err := s.List(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, exportMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint8(exportVersion)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, s.mtId); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, root[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(len(kvs))); err != nil {
+		return err
+	}
+
+	for _, kv := range kvs {
+		if err := writeNodeRecord(w, kv.K, &kv.V); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeNodeRecord(w io.Writer, key []byte, node *merkletree.Node) error {
+	if err := writeBytes(w, key); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, byte(node.Type)); err != nil {
+		return err
+	}
+	if err := writeHash(w, node.ChildL); err != nil {
+		return err
+	}
+	if err := writeHash(w, node.ChildR); err != nil {
+		return err
+	}
+	var entry []byte
+	if node.Entry[0] != nil && node.Entry[1] != nil {
+		entry = append(node.Entry[0][:], node.Entry[1][:]...)
+	}
+	return writeBytes(w, entry)
+}
+
+func writeBytes(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func writeHash(w io.Writer, h *merkletree.Hash) error {
+	if h == nil {
+		return binary.Write(w, binary.BigEndian, byte(0))
+	}
+	if err := binary.Write(w, binary.BigEndian, byte(1)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, h[:])
+}
+
+// Import reads a snapshot produced by Export and writes its nodes and root
+// to this Storage's mt_id, through the regular Put/SetRoot path so the
+// import becomes the next version in this mt_id's history. It refuses to
+// overwrite a non-empty mt_id unless force is true, and rejects the
+// snapshot if the claimed root and its children don't resolve against the
+// imported nodes.
+func (s *Storage) Import(ctx context.Context, r io.Reader, force bool) error {
+	if !force {
+		empty, err := s.isEmpty(ctx)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrImportNotEmpty
+		}
+	}
+
+	var magic [4]byte
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return fmt.Errorf("sql: failed to read snapshot header: %w", err)
+	}
+	if magic != exportMagic {
+		return fmt.Errorf("%w: bad magic", ErrImportCorrupt)
+	}
+	var version uint8
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != exportVersion {
+		return fmt.Errorf("%w: unsupported format version %d", ErrImportCorrupt, version)
+	}
+	var mtId uint64
+	if err := binary.Read(r, binary.BigEndian, &mtId); err != nil {
+		return err
+	}
+	var root merkletree.Hash
+	if err := binary.Read(r, binary.BigEndian, root[:]); err != nil {
+		return err
+	}
+	var count uint64
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+
+	nodes := make(map[string]*merkletree.Node, count)
+	keys := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, node, err := readNodeRecord(r)
+		if err != nil {
+			return fmt.Errorf("sql: failed to read node record %d: %w", i, err)
+		}
+		nodes[string(key)] = node
+		keys = append(keys, key)
+	}
+
+	if err := validateSnapshot(nodes, &root); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.Put(ctx, key, nodes[string(key)]); err != nil {
+			return err
+		}
+	}
+	return s.SetRoot(ctx, &root)
+}
+
+func readNodeRecord(r io.Reader) ([]byte, *merkletree.Node, error) {
+	key, err := readBytes(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var typ byte
+	if err := binary.Read(r, binary.BigEndian, &typ); err != nil {
+		return nil, nil, err
+	}
+	childL, err := readHash(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	childR, err := readHash(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := readBytes(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	node := &merkletree.Node{Type: merkletree.NodeType(typ), ChildL: childL, ChildR: childR}
+	if len(entry) > 0 {
+		if len(entry) != 2*merkletree.ElemBytesLen {
+			return nil, nil, merkletree.ErrNodeBytesBadSize
+		}
+		node.Entry = [2]*merkletree.Hash{{}, {}}
+		copy(node.Entry[0][:], entry[0:32])
+		copy(node.Entry[1][:], entry[32:64])
+	}
+	return key, node, nil
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func readHash(r io.Reader) (*merkletree.Hash, error) {
+	var present byte
+	if err := binary.Read(r, binary.BigEndian, &present); err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	h := &merkletree.Hash{}
+	if err := binary.Read(r, binary.BigEndian, h[:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// validateSnapshot does the minimum viable check that a snapshot is
+// internally consistent without recomputing any hashes: the claimed root,
+// if not empty, must be one of the imported nodes, and every non-empty child
+// reference from an imported node must resolve to another imported node.
+func validateSnapshot(nodes map[string]*merkletree.Node, root *merkletree.Hash) error {
+	var zero merkletree.Hash
+	if *root != zero {
+		if _, ok := nodes[string(root[:])]; !ok {
+			return fmt.Errorf("%w: root node not found among imported nodes", ErrImportCorrupt)
+		}
+	}
+	for key, node := range nodes {
+		if node.ChildL != nil && *node.ChildL != zero {
+			if _, ok := nodes[string(node.ChildL[:])]; !ok {
+				return fmt.Errorf("%w: node %x references missing left child", ErrImportCorrupt, key)
+			}
+		}
+		if node.ChildR != nil && *node.ChildR != zero {
+			if _, ok := nodes[string(node.ChildR[:])]; !ok {
+				return fmt.Errorf("%w: node %x references missing right child", ErrImportCorrupt, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) isEmpty(ctx context.Context) (bool, error) {
+	kvs, err := s.List(ctx, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(kvs) == 0, nil
+}
@@ -3,36 +3,24 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"errors"
 
 	"github.com/iden3/go-merkletree-sql/v2"
+	"github.com/jmoiron/sqlx"
 )
 
-const schema = `
-  CREATE TABLE IF NOT EXISTS mt_nodes (
-    mt_id INTEGER,
-    key BLOB,
-    type INTEGER NOT NULL,
-    child_l BLOB,
-    child_r BLOB,
-    entry BLOB,
-    created_at INTEGER,
-    deleted_at INTEGER,
-    PRIMARY KEY(mt_id, key)
-  );
-
-  CREATE TABLE IF NOT EXISTS mt_roots (
-    mt_id INTEGER PRIMARY KEY,
-    key BLOB,
-    created_at INTEGER,
-    deleted_at INTEGER
-  );
-`
-
-const upsertStmt = `INSERT INTO mt_nodes (mt_id, key, type, child_l, child_r, entry) VALUES (?, ?, ?, ?, ?, ?) ` +
-	`ON CONFLICT (mt_id, key) DO UPDATE SET type = ?, child_l = ?, child_r = ?, entry = ?`
-
-const updateRootStmt = `INSERT INTO mt_roots (mt_id, key) VALUES (?, ?) ` +
-	`ON CONFLICT (mt_id) DO UPDATE SET key = ?`
+// retireNodeStmt marks the currently live row for a key as superseded by
+// stamping its deleted_at with the version of the row replacing it. It
+// excludes a row already at the incoming version: Put may be called more
+// than once for the same key before the version is next bumped by
+// SetRoot, and those repeated writes must update that row in place (via
+// Dialect.UpsertNode's upsert) rather than retiring it out from under
+// itself.
+const retireNodeStmt = `UPDATE mt_nodes SET deleted_at = ? WHERE mt_id = ? AND key = ? ` +
+	`AND deleted_at IS NULL AND created_at <> ?`
+
+// retireRootStmt marks the currently live root row as superseded.
+const retireRootStmt = `UPDATE mt_roots SET deleted_at = ? WHERE mt_id = ? AND prefix = ? AND deleted_at IS NULL`
 
 type DB interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
@@ -44,10 +32,81 @@ type DB interface {
 type Storage struct {
 	db             DB
 	mtId           uint64
+	dialect        Dialect
+	prefix         []byte
 	currentVersion uint64
+	versionLoaded  bool
 	currentRoot    *merkletree.Hash
 }
 
+// WithPrefix returns a shallow copy of Storage namespaced under prefix: node
+// keys read or written through the returned Storage are prefix||key under
+// the hood, and its root is tracked separately from every other prefix.
+// This lets several logical sub-trees - e.g. nested identity claims - share
+// a single mt_id while still behaving like independent trees.
+func (s *Storage) WithPrefix(prefix []byte) *Storage {
+	ns := *s
+	ns.prefix = append(append([]byte{}, s.prefix...), prefix...)
+	ns.currentRoot = nil
+	ns.currentVersion = 0
+	ns.versionLoaded = false
+	return &ns
+}
+
+// ensureVersionLoaded seeds currentVersion from the highest root version
+// already committed for this (mtId, prefix), the first time this Storage
+// writes. Without it, a freshly constructed handle over an mt_id that
+// already has history - a process restart against a persisted file, or a
+// second handle opened concurrently - would start counting from 0 again and
+// collide with the rows a prior handle already wrote.
+func (s *Storage) ensureVersionLoaded(ctx context.Context) error {
+	if s.versionLoaded {
+		return nil
+	}
+	var version uint64
+	if err := s.get(ctx, &version,
+		"SELECT COALESCE(MAX(created_at), 0) FROM mt_roots WHERE mt_id = ? AND prefix = ?",
+		s.mtId, s.rootPrefix()); err != nil {
+		return newErr(err, "failed to load current version")
+	}
+	s.currentVersion = version
+	s.versionLoaded = true
+	return nil
+}
+
+func (s *Storage) prefixed(key []byte) []byte {
+	if len(s.prefix) == 0 {
+		return key
+	}
+	return append(append([]byte{}, s.prefix...), key...)
+}
+
+// rootPrefix returns s.prefix as a non-nil slice, so it always binds to a
+// BLOB/BYTEA value rather than NULL: mt_roots' primary key includes prefix,
+// and NULL would break the uniqueness check a plain byte comparison gives
+// us.
+func (s *Storage) rootPrefix() []byte {
+	if s.prefix == nil {
+		return []byte{}
+	}
+	return s.prefix
+}
+
+// prefixUpperBound returns the smallest key that sorts after every key
+// starting with prefix, so "key >= prefix AND key < upperBound" selects
+// exactly that prefix's keys. It returns nil when prefix is all 0xff bytes
+// (or empty), meaning there is no finite upper bound to apply.
+func prefixUpperBound(prefix []byte) []byte {
+	upper := append([]byte{}, prefix...)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] != 0xff {
+			upper[i]++
+			return upper[:i+1]
+		}
+	}
+	return nil
+}
+
 type NodeItem struct {
 	MTId uint64 `db:"mt_id"`
 	Key  []byte `db:"key"`
@@ -65,22 +124,46 @@ type NodeItem struct {
 
 type RootItem struct {
 	MTId      uint64  `db:"mt_id"`
+	Prefix    []byte  `db:"prefix"`
 	Key       []byte  `db:"key"`
 	CreatedAt *uint64 `db:"created_at"`
 	DeletedAt *uint64 `db:"deleted_at"`
 }
 
-// NewSqlStorage returns a new Storage
-func NewSqlStorage(db DB, mtId uint64) *Storage {
-	return &Storage{db: db, mtId: mtId}
+// NewSqlStorage returns a new Storage that speaks the given SQL dialect.
+func NewSqlStorage(db DB, mtId uint64, dialect Dialect) *Storage {
+	return &Storage{db: db, mtId: mtId, dialect: dialect}
+}
+
+// NewSqliteStorage returns a new Storage backed by SQLite. It is a
+// convenience shim over NewSqlStorage(db, mtId, SQLiteDialect{}) kept for
+// existing callers.
+func NewSqliteStorage(db DB, mtId uint64) *Storage {
+	return NewSqlStorage(db, mtId, SQLiteDialect{})
+}
+
+// exec runs a portable "?"-placeholder statement, rewriting the
+// placeholders for the Storage's dialect first.
+func (s *Storage) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, bind(s.dialect, query), args...)
+}
+
+// get runs a portable "?"-placeholder query expecting a single row.
+func (s *Storage) get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return s.db.GetContext(ctx, dest, bind(s.dialect, query), args...)
+}
+
+// selectRows runs a portable "?"-placeholder query expecting multiple rows.
+func (s *Storage) selectRows(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return s.db.SelectContext(ctx, dest, bind(s.dialect, query), args...)
 }
 
 // Get retrieves a value from a key in the db.Storage
 func (s *Storage) Get(ctx context.Context,
 	key []byte) (*merkletree.Node, error) {
 	item := NodeItem{}
-	err := s.db.GetContext(ctx, &item,
-		"SELECT * FROM mt_nodes WHERE mt_id = ? AND key = ?", s.mtId, key)
+	err := s.get(ctx, &item,
+		"SELECT * FROM mt_nodes WHERE mt_id = ? AND key = ? AND deleted_at IS NULL", s.mtId, s.prefixed(key))
 	if err == sql.ErrNoRows {
 		return nil, merkletree.ErrNotFound
 	}
@@ -112,8 +195,17 @@ func (s *Storage) Put(ctx context.Context, key []byte,
 		entry = append(node.Entry[0][:], node.Entry[1][:]...)
 	}
 
-	_, err := s.db.ExecContext(ctx, upsertStmt, s.mtId, key[:], node.Type,
-		childL, childR, entry, node.Type, childL, childR, entry)
+	if err := s.ensureVersionLoaded(ctx); err != nil {
+		return err
+	}
+
+	key = s.prefixed(key)
+	version := s.currentVersion
+	if _, err := s.exec(ctx, retireNodeStmt, version, s.mtId, key, version); err != nil {
+		return newErr(err, "failed to retire previous node version")
+	}
+	_, err := s.db.ExecContext(ctx, s.dialect.UpsertNode(), s.mtId, key, node.Type,
+		childL, childR, entry, version)
 	return err
 }
 
@@ -128,8 +220,8 @@ func (s *Storage) GetRoot(ctx context.Context) (*merkletree.Hash, error) {
 	}
 
 	item := RootItem{}
-	err = s.db.GetContext(ctx, &item,
-		"SELECT * FROM mt_roots WHERE mt_id = ?", s.mtId)
+	err = s.get(ctx, &item,
+		"SELECT * FROM mt_roots WHERE mt_id = ? AND prefix = ? AND deleted_at IS NULL", s.mtId, s.rootPrefix())
 	if err == sql.ErrNoRows {
 		return nil, merkletree.ErrNotFound
 	}
@@ -145,17 +237,342 @@ func (s *Storage) GetRoot(ctx context.Context) (*merkletree.Hash, error) {
 }
 
 func (s *Storage) SetRoot(ctx context.Context, hash *merkletree.Hash) error {
+	if err := s.ensureVersionLoaded(ctx); err != nil {
+		return err
+	}
+
 	if s.currentRoot == nil {
 		s.currentRoot = &merkletree.Hash{}
 	}
 	copy(s.currentRoot[:], hash[:])
-	_, err := s.db.ExecContext(ctx, updateRootStmt, s.mtId, s.currentRoot[:], s.currentRoot[:])
+
+	s.currentVersion++
+	if _, err := s.exec(ctx, retireRootStmt, s.currentVersion, s.mtId, s.rootPrefix()); err != nil {
+		return newErr(err, "failed to retire previous root version")
+	}
+	_, err := s.db.ExecContext(ctx, s.dialect.UpsertRoot(), s.mtId, s.rootPrefix(), s.currentRoot[:], s.currentVersion)
 	if err != nil {
 		err = newErr(err, "failed to update current root hash")
 	}
 	return err
 }
 
+// GetRootAtVersion retrieves the merkle tree root hash as it was at version
+// v, i.e. the root that was live at or before v and had not yet been
+// superseded at v.
+func (s *Storage) GetRootAtVersion(ctx context.Context, v uint64) (*merkletree.Hash, error) {
+	item := RootItem{}
+	err := s.get(ctx, &item,
+		`SELECT * FROM mt_roots WHERE mt_id = ? AND prefix = ? AND created_at <= ? `+
+			`AND (deleted_at IS NULL OR deleted_at > ?)`, s.mtId, s.rootPrefix(), v, v)
+	if err == sql.ErrNoRows {
+		return nil, merkletree.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	root := &merkletree.Hash{}
+	copy(root[:], item.Key[:])
+	return root, nil
+}
+
+// GetNodeAtVersion retrieves the node stored under key as it was at version
+// v, i.e. the node that was live at or before v and had not yet been
+// superseded at v.
+func (s *Storage) GetNodeAtVersion(ctx context.Context, key []byte, v uint64) (*merkletree.Node, error) {
+	item := NodeItem{}
+	err := s.get(ctx, &item,
+		`SELECT * FROM mt_nodes WHERE mt_id = ? AND key = ? AND created_at <= ? `+
+			`AND (deleted_at IS NULL OR deleted_at > ?)`, s.mtId, s.prefixed(key), v, v)
+	if err == sql.ErrNoRows {
+		return nil, merkletree.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Node()
+}
+
+// ListVersions returns every version number the tree's root has been set
+// to, oldest first.
+func (s *Storage) ListVersions(ctx context.Context) ([]uint64, error) {
+	var versions []uint64
+	err := s.selectRows(ctx, &versions,
+		"SELECT created_at FROM mt_roots WHERE mt_id = ? AND prefix = ? ORDER BY created_at",
+		s.mtId, s.rootPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Prune deletes superseded node and root rows whose deleted_at is below
+// currentVersion-keepVersions, so the history of at least the last
+// keepVersions versions is kept. A keepVersions of 0 (or less) removes the
+// rows superseded before the current version; rows superseded at the current
+// version are kept. A keepVersions at or above the current version removes
+// nothing.
+func (s *Storage) Prune(ctx context.Context, keepVersions int) error {
+	if err := s.ensureVersionLoaded(ctx); err != nil {
+		return err
+	}
+
+	var minVersion uint64
+	switch {
+	case keepVersions <= 0:
+		minVersion = s.currentVersion
+	case uint64(keepVersions) < s.currentVersion:
+		minVersion = s.currentVersion - uint64(keepVersions)
+	}
+	lower, upper, scoped := s.prefixBounds()
+	nodeQuery := "DELETE FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NOT NULL AND deleted_at < ?"
+	nodeArgs := []interface{}{s.mtId, minVersion}
+	if scoped {
+		nodeQuery += " AND key >= ?"
+		nodeArgs = append(nodeArgs, lower)
+		if upper != nil {
+			nodeQuery += " AND key < ?"
+			nodeArgs = append(nodeArgs, upper)
+		}
+	}
+	if _, err := s.exec(ctx, nodeQuery, nodeArgs...); err != nil {
+		return newErr(err, "failed to prune node history")
+	}
+	if _, err := s.exec(ctx,
+		"DELETE FROM mt_roots WHERE mt_id = ? AND prefix = ? AND deleted_at IS NOT NULL AND deleted_at < ?",
+		s.mtId, s.rootPrefix(), minVersion); err != nil {
+		return newErr(err, "failed to prune root history")
+	}
+	return nil
+}
+
+// txBeginner is implemented by *sqlx.DB. When the underlying DB supports it,
+// Tx.Commit runs the buffered writes inside a real database transaction so
+// they become visible atomically.
+type txBeginner interface {
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+}
+
+// ErrTxClosed is returned when Get, Put, SetRoot or Commit is called on a Tx
+// that has already been committed or closed.
+var ErrTxClosed = errors.New("sql: transaction already committed or closed")
+
+// Tx is a transactional handle over a Storage. Writes made through Put and
+// SetRoot are buffered in memory and only become visible to Get/GetRoot on
+// the underlying Storage once Commit succeeds, at which point they are
+// applied together. The update is all-or-nothing only when the underlying DB
+// can begin a real transaction (see Commit).
+type Tx struct {
+	storage      *Storage
+	pendingNodes map[string]*merkletree.Node
+	pendingRoot  *merkletree.Hash
+	rootSet      bool
+	closed       bool
+}
+
+// NewTx returns a new Tx over the Storage.
+func (s *Storage) NewTx(ctx context.Context) (*Tx, error) {
+	return &Tx{storage: s, pendingNodes: make(map[string]*merkletree.Node)}, nil
+}
+
+// Get retrieves a value from a key, preferring a write buffered in this
+// transaction over the committed value in the underlying Storage.
+func (tx *Tx) Get(ctx context.Context, key []byte) (*merkletree.Node, error) {
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	if node, ok := tx.pendingNodes[string(key)]; ok {
+		return node, nil
+	}
+	return tx.storage.Get(ctx, key)
+}
+
+// Put buffers a node write to be applied on Commit.
+func (tx *Tx) Put(ctx context.Context, key []byte, node *merkletree.Node) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.pendingNodes[string(key)] = node
+	return nil
+}
+
+// SetRoot buffers a root update to be applied on Commit.
+func (tx *Tx) SetRoot(ctx context.Context, hash *merkletree.Hash) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	root := *hash
+	tx.pendingRoot = &root
+	tx.rootSet = true
+	return nil
+}
+
+// Commit applies the buffered writes to the underlying Storage. When the
+// underlying DB supports beginning a real transaction, the writes are
+// applied inside it so that they become visible atomically; otherwise they
+// are applied sequentially on a best-effort basis.
+func (tx *Tx) Commit(ctx context.Context) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	defer func() { tx.closed = true }()
+
+	if beginner, ok := tx.storage.db.(txBeginner); ok {
+		dbTx, err := beginner.BeginTxx(ctx, nil)
+		if err != nil {
+			return newErr(err, "failed to begin transaction")
+		}
+		txStorage := &Storage{
+			db:             dbTx,
+			mtId:           tx.storage.mtId,
+			dialect:        tx.storage.dialect,
+			prefix:         tx.storage.prefix,
+			currentVersion: tx.storage.currentVersion,
+		}
+		if err := tx.flush(ctx, txStorage); err != nil {
+			_ = dbTx.Rollback()
+			return err
+		}
+		if err := dbTx.Commit(); err != nil {
+			return newErr(err, "failed to commit transaction")
+		}
+		tx.storage.currentVersion = txStorage.currentVersion
+	} else if err := tx.flush(ctx, tx.storage); err != nil {
+		return err
+	}
+
+	if tx.rootSet {
+		tx.storage.currentRoot = tx.pendingRoot
+	}
+	return nil
+}
+
+func (tx *Tx) flush(ctx context.Context, s *Storage) error {
+	for k, node := range tx.pendingNodes {
+		if err := s.Put(ctx, []byte(k), node); err != nil {
+			return err
+		}
+	}
+	if tx.rootSet {
+		if err := s.SetRoot(ctx, tx.pendingRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close discards any buffered writes without applying them. It is a no-op
+// if the transaction has already been committed or closed.
+func (tx *Tx) Close() error {
+	tx.closed = true
+	tx.pendingNodes = nil
+	return nil
+}
+
+// iterateChunkSize bounds the number of rows fetched per round-trip by
+// Iterate, so walking a large tree doesn't require loading it all into
+// memory at once.
+const iterateChunkSize = 100
+
+// prefixBounds returns the [lower, upper) key range that selects exactly
+// the mt_nodes rows belonging to s.prefix, and whether s is scoped to a
+// prefix at all. upper is nil when there is no finite upper bound (see
+// prefixUpperBound).
+func (s *Storage) prefixBounds() (lower, upper []byte, scoped bool) {
+	if len(s.prefix) == 0 {
+		return nil, nil, false
+	}
+	return s.prefix, prefixUpperBound(s.prefix), true
+}
+
+// Iterate walks every live node in this Storage's namespace (its mt_id, and
+// its prefix if it was derived via WithPrefix) in key order, calling f for
+// each one with its unprefixed key. It stops and returns nil as soon as f
+// returns false, and stops and returns an error as soon as f (or the
+// underlying query) returns one.
+func (s *Storage) Iterate(ctx context.Context, f func(key []byte, n *merkletree.Node) (bool, error)) error {
+	_, upper, scoped := s.prefixBounds()
+	cursor := s.prefix
+	haveCursor := false
+	for {
+		query := "SELECT * FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NULL"
+		args := []interface{}{s.mtId}
+		switch {
+		case haveCursor:
+			query += " AND key > ?"
+			args = append(args, cursor)
+		case scoped:
+			query += " AND key >= ?"
+			args = append(args, cursor)
+		}
+		if scoped && upper != nil {
+			query += " AND key < ?"
+			args = append(args, upper)
+		}
+		query += " ORDER BY key LIMIT ?"
+		args = append(args, iterateChunkSize)
+
+		var items []NodeItem
+		if err := s.selectRows(ctx, &items, query, args...); err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for _, item := range items {
+			node, err := item.Node()
+			if err != nil {
+				return err
+			}
+			cont, err := f(item.Key[len(s.prefix):], node)
+			if err != nil {
+				return err
+			}
+			if !cont {
+				return nil
+			}
+		}
+		cursor = items[len(items)-1].Key
+		haveCursor = true
+	}
+}
+
+// List returns up to limit live nodes in this Storage's namespace (its
+// mt_id, and its prefix if it was derived via WithPrefix) in key order,
+// with keys unprefixed. A limit of 0 returns every node.
+func (s *Storage) List(ctx context.Context, limit int) ([]KV, error) {
+	lower, upper, scoped := s.prefixBounds()
+	query := "SELECT * FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NULL"
+	args := []interface{}{s.mtId}
+	if scoped {
+		query += " AND key >= ?"
+		args = append(args, lower)
+		if upper != nil {
+			query += " AND key < ?"
+			args = append(args, upper)
+		}
+	}
+	query += " ORDER BY key"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	var items []NodeItem
+	if err := s.selectRows(ctx, &items, query, args...); err != nil {
+		return nil, err
+	}
+
+	kvs := make([]KV, 0, len(items))
+	for _, item := range items {
+		node, err := item.Node()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, KV{MTId: s.mtId, K: item.Key[len(s.prefix):], V: *node})
+	}
+	return kvs, nil
+}
+
 func (item *NodeItem) Node() (*merkletree.Node, error) {
 	node := merkletree.Node{
 		Type: merkletree.NodeType(item.Type),
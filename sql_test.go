@@ -1,7 +1,10 @@
 package sql
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"sync/atomic"
 	"testing"
@@ -21,12 +24,12 @@ func (builder *SqlStorageBuilder) NewStorage(t *testing.T) merkletree.Storage {
 	db, err := sqlx.Open("sqlite3", ":memory:")
 	require.NoError(t, err)
 
-	_, err = db.Exec(schema)
+	_, err = db.Exec(sqliteSchema)
 	require.NoError(t, err)
 
 	mtId := atomic.AddUint64(&maxMTId, 1)
 
-	return NewSqlStorage(db, mtId)
+	return NewSqliteStorage(db, mtId)
 }
 
 func TestSql(t *testing.T) {
@@ -34,6 +37,302 @@ func TestSql(t *testing.T) {
 	test.TestAll(t, builder)
 }
 
+func TestTxVisibility(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	key := []byte("k1")
+	node := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+
+	tx, err := storage.NewTx(ctx)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(ctx, key, node))
+
+	// Uncommitted writes are visible through the Tx, but not through the
+	// Storage it was opened on.
+	_, err = storage.Get(ctx, key)
+	require.Equal(t, merkletree.ErrNotFound, err)
+	got, err := tx.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, node.Type, got.Type)
+
+	require.NoError(t, tx.Commit(ctx))
+
+	got, err = storage.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, node.Type, got.Type)
+}
+
+func TestTxClose(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	key := []byte("k2")
+	node := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+
+	tx, err := storage.NewTx(ctx)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(ctx, key, node))
+	require.NoError(t, tx.Close())
+
+	_, err = storage.Get(ctx, key)
+	require.Equal(t, merkletree.ErrNotFound, err)
+
+	_, err = tx.Get(ctx, key)
+	require.Equal(t, ErrTxClosed, err)
+}
+
+func TestPutSameKeySameVersion(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	key := []byte("k3")
+	first := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	second := &merkletree.Node{Type: merkletree.NodeTypeMiddle, ChildL: &merkletree.Hash{}, ChildR: &merkletree.Hash{}}
+
+	// Two Puts for the same key before the next SetRoot must both succeed
+	// and leave the later write live, rather than colliding on the row's
+	// (mt_id, key, created_at) primary key.
+	require.NoError(t, storage.Put(ctx, key, first))
+	require.NoError(t, storage.Put(ctx, key, second))
+
+	got, err := storage.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, second.Type, got.Type)
+}
+
+func TestWithPrefixIndependentTrees(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	claims := storage.WithPrefix([]byte("claims/"))
+	revocations := storage.WithPrefix([]byte("revocations/"))
+
+	claimsRoot := merkletree.Hash{1}
+	revocationsRoot := merkletree.Hash{2}
+	require.NoError(t, claims.SetRoot(ctx, &claimsRoot))
+	require.NoError(t, revocations.SetRoot(ctx, &revocationsRoot))
+
+	gotClaims, err := claims.GetRoot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, claimsRoot, *gotClaims)
+
+	gotRevocations, err := revocations.GetRoot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, revocationsRoot, *gotRevocations)
+
+	claimNode := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	revocationNode := &merkletree.Node{Type: merkletree.NodeTypeMiddle, ChildL: &merkletree.Hash{}, ChildR: &merkletree.Hash{}}
+	require.NoError(t, claims.Put(ctx, []byte("k"), claimNode))
+	require.NoError(t, revocations.Put(ctx, []byte("k"), revocationNode))
+
+	// List on one prefix must not see the other prefix's nodes, and
+	// must return keys with the prefix stripped back off.
+	claimKVs, err := claims.List(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, claimKVs, 1)
+	require.Equal(t, []byte("k"), claimKVs[0].K)
+	require.Equal(t, claimNode.Type, claimKVs[0].V.Type)
+
+	revocationKVs, err := revocations.List(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, revocationKVs, 1)
+	require.Equal(t, []byte("k"), revocationKVs[0].K)
+	require.Equal(t, revocationNode.Type, revocationKVs[0].V.Type)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	src := builder.NewStorage(t).(*Storage)
+	dst := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	leaf := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	leafKey, err := leaf.Key()
+	require.NoError(t, err)
+	require.NoError(t, src.Put(ctx, leafKey[:], leaf))
+
+	root := &merkletree.Hash{}
+	copy(root[:], leafKey[:])
+	require.NoError(t, src.SetRoot(ctx, root))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(ctx, &buf))
+
+	require.NoError(t, dst.Import(ctx, &buf, false))
+
+	gotRoot, err := dst.GetRoot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, *root, *gotRoot)
+
+	got, err := dst.Get(ctx, leafKey[:])
+	require.NoError(t, err)
+	require.Equal(t, leaf.Type, got.Type)
+}
+
+func TestImportNotEmpty(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	src := builder.NewStorage(t).(*Storage)
+	dst := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	require.NoError(t, src.SetRoot(ctx, &merkletree.Hash{}))
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(ctx, &buf))
+
+	leaf := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	leafKey, err := leaf.Key()
+	require.NoError(t, err)
+	require.NoError(t, dst.Put(ctx, leafKey[:], leaf))
+
+	require.ErrorIs(t, dst.Import(ctx, &buf, false), ErrImportNotEmpty)
+}
+
+func TestVersionSeededFromExistingHistory(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	_, err = db.Exec(sqliteSchema)
+	require.NoError(t, err)
+
+	mtId := atomic.AddUint64(&maxMTId, 1)
+	ctx := context.Background()
+
+	s1 := NewSqliteStorage(db, mtId)
+	root1 := merkletree.Hash{1}
+	root2 := merkletree.Hash{2}
+	require.NoError(t, s1.SetRoot(ctx, &root1))
+	require.NoError(t, s1.SetRoot(ctx, &root2))
+
+	// A fresh handle over an mt_id that already has history must pick up
+	// the existing version count instead of starting back at 0 and
+	// colliding with s1's rows.
+	s2 := NewSqliteStorage(db, mtId)
+	root3 := merkletree.Hash{3}
+	require.NoError(t, s2.SetRoot(ctx, &root3))
+
+	s3 := NewSqliteStorage(db, mtId)
+	got, err := s3.GetRoot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, root3, *got)
+}
+
+func TestPruneRemovesAllSupersededWhenKeepVersionsZero(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	_, err = db.Exec(sqliteSchema)
+	require.NoError(t, err)
+
+	mtId := atomic.AddUint64(&maxMTId, 1)
+	ctx := context.Background()
+	storage := NewSqliteStorage(db, mtId)
+
+	key := []byte("k")
+	node1 := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	node2 := &merkletree.Node{Type: merkletree.NodeTypeMiddle, ChildL: &merkletree.Hash{}, ChildR: &merkletree.Hash{}}
+	// SetRoot between the Puts bumps the version, so node2 supersedes node1.
+	require.NoError(t, storage.Put(ctx, key, node1))
+	require.NoError(t, storage.SetRoot(ctx, &merkletree.Hash{1}))
+	require.NoError(t, storage.Put(ctx, key, node2))
+	require.NoError(t, storage.SetRoot(ctx, &merkletree.Hash{2}))
+
+	require.NoError(t, storage.Prune(ctx, 0))
+
+	var count int
+	require.NoError(t, db.Get(&count,
+		"SELECT COUNT(*) FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NOT NULL", mtId))
+	require.Equal(t, 0, count)
+}
+
+func TestPruneScopedToPrefix(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	_, err = db.Exec(sqliteSchema)
+	require.NoError(t, err)
+
+	mtId := atomic.AddUint64(&maxMTId, 1)
+	ctx := context.Background()
+	storage := NewSqliteStorage(db, mtId)
+	claims := storage.WithPrefix([]byte("claims/"))
+	revocations := storage.WithPrefix([]byte("revocations/"))
+
+	key := []byte("k")
+	first := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+	second := &merkletree.Node{Type: merkletree.NodeTypeMiddle, ChildL: &merkletree.Hash{}, ChildR: &merkletree.Hash{}}
+
+	// One retired row under each prefix, sharing the same mt_id: each Put
+	// needs its own SetRoot in between to bump the version, otherwise the
+	// second Put just updates the first version's row in place instead of
+	// superseding it.
+	require.NoError(t, claims.Put(ctx, key, first))
+	require.NoError(t, claims.SetRoot(ctx, &merkletree.Hash{1}))
+	require.NoError(t, claims.Put(ctx, key, second))
+	require.NoError(t, claims.SetRoot(ctx, &merkletree.Hash{2}))
+
+	require.NoError(t, revocations.Put(ctx, key, first))
+	require.NoError(t, revocations.SetRoot(ctx, &merkletree.Hash{3}))
+	require.NoError(t, revocations.Put(ctx, key, second))
+	require.NoError(t, revocations.SetRoot(ctx, &merkletree.Hash{4}))
+
+	var countBefore int
+	require.NoError(t, db.Get(&countBefore,
+		"SELECT COUNT(*) FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NOT NULL", mtId))
+	require.Equal(t, 2, countBefore)
+
+	// Pruning the claims sub-tree must not touch revocations' history.
+	require.NoError(t, claims.Prune(ctx, 0))
+
+	var countAfter int
+	require.NoError(t, db.Get(&countAfter,
+		"SELECT COUNT(*) FROM mt_nodes WHERE mt_id = ? AND deleted_at IS NOT NULL", mtId))
+	require.Equal(t, 1, countAfter)
+}
+
+func TestIteratePaginatesAcrossChunks(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	const n = iterateChunkSize + 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		node := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+		require.NoError(t, storage.Put(ctx, key, node))
+	}
+
+	seen := make(map[string]bool, n)
+	err := storage.Iterate(ctx, func(key []byte, node *merkletree.Node) (bool, error) {
+		seen[string(key)] = true
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, n)
+}
+
+func TestIterateStopsOnFalse(t *testing.T) {
+	builder := &SqlStorageBuilder{}
+	storage := builder.NewStorage(t).(*Storage)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		node := &merkletree.Node{Type: merkletree.NodeTypeLeaf, Entry: [2]*merkletree.Hash{{}, {}}}
+		require.NoError(t, storage.Put(ctx, key, node))
+	}
+
+	var seen int
+	err := storage.Iterate(ctx, func(key []byte, node *merkletree.Node) (bool, error) {
+		seen++
+		return false, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, seen)
+}
+
 func TestErrors(t *testing.T) {
 	err := storageError{
 		err: io.EOF,